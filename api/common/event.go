@@ -1,8 +1,11 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/nccgroup/tracy/api/store"
 	"github.com/nccgroup/tracy/api/types"
@@ -71,12 +74,37 @@ func AddEvent(tracer types.Tracer, event types.TracerEvent) ([]byte, error) {
 		err error
 	)
 
-	// Only check for DOM contexts when we have format type HTML.
-	if event.RawEvent.Format == types.HTML {
-		if err = getDOMContexts(&event, tracer); err != nil {
+	start := time.Now()
+	_, span := startSpan(context.Background(), "AddEvent", tracer.ID, tracer.TracerPayload, event.EventType)
+	defer func() {
+		ingestDuration.Observe(time.Since(start).Seconds())
+		recordTrace(traceRecord{Name: "AddEvent", TracerID: tracer.ID, Duration: time.Since(start), At: start})
+		if err != nil {
+			ingestErrorsTotal.Inc()
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+	eventsTotal.Inc()
+
+	// Properties are restricted to string/number/bool so they can be stored
+	// in indexable columns; anything else is rejected here so the caller can
+	// turn it into an HTTP 400 before we touch the database.
+	if err = validateProperties(event.Properties); err != nil {
+		log.Warning.Print(err)
+		return ret, err
+	}
+
+	// Dispatch to whichever format handler is registered for this raw
+	// event's format (HTML, JSON, XML, JS, CSS, or plain text) so each gets
+	// its own context/severity rules instead of only ever checking HTML.
+	if handler, ok := formatHandlers[event.RawEvent.Format]; ok {
+		var contexts []types.DOMContext
+		if contexts, err = handler(event.RawEvent.Data, tracer, event); err != nil {
 			log.Warning.Print(err)
 			return ret, err
 		}
+		event.DOMContexts = contexts
 	}
 
 	// We've already added the raw event to get a valid raw event ID, so remove
@@ -90,6 +118,13 @@ func AddEvent(tracer types.Tracer, event types.TracerEvent) ([]byte, error) {
 		return ret, err
 	}
 
+	if len(copy.Properties) > 0 {
+		if err = saveEventProperties(event.ID, copy.Properties); err != nil {
+			log.Warning.Print(err)
+			return ret, err
+		}
+	}
+
 	// We update the subscribers with the copy instead of the event because
 	// we don't want to erase the already recorded events that client might
 	// be showing.
@@ -104,7 +139,7 @@ func AddEvent(tracer types.Tracer, event types.TracerEvent) ([]byte, error) {
 	// with severity of 2 or higher.
 	for _, c := range copy.DOMContexts {
 		if c.Severity >= 2 {
-			UpdateSubscribers(types.Notification{Tracer: tracer, Event: copy})
+			notifyHighSeverity(tracer, copy)
 			break
 		}
 	}
@@ -113,7 +148,7 @@ func AddEvent(tracer types.Tracer, event types.TracerEvent) ([]byte, error) {
 
 // getDomContexts searches through the raw tracer event that should be HTML and
 // finds all of tracer occurrences specified by the tracer passed in.
-func getDOMContexts(event *types.TracerEvent, tracer types.Tracer) error {
+func getDOMContexts(ctx context.Context, event *types.TracerEvent, tracer types.Tracer) error {
 	var (
 		contexts []types.DOMContext
 		sev      uint
@@ -122,17 +157,49 @@ func getDOMContexts(event *types.TracerEvent, tracer types.Tracer) error {
 		doc      *html.Node
 	)
 
+	ctx, span := startSpan(ctx, "getDOMContexts", tracer.ID, tracer.TracerPayload, event.EventType)
+	defer span.End()
+
 	// Parse the event as an HTML document so we can inspect the DOM for where
 	// user-input was output.
-	if doc, err = html.Parse(strings.NewReader(event.RawEvent.Data)); err != nil {
+	parseStart := time.Now()
+	doc, err = html.Parse(strings.NewReader(event.RawEvent.Data))
+	htmlParseDuration.Observe(time.Since(parseStart).Seconds())
+	if err != nil {
 		log.Warning.Print(err)
+		span.RecordError(err)
 		return err
 	}
 
 	old := tracer.HasTracerEvents
 
+	// Look up the scoring script configured for this tracer (scripts are
+	// stored per tracer ID, not shared across a project), falling back to
+	// the built-in default so behavior is unchanged when none has been set.
+	customScript, topCallOnly := GetTracerScript(tracer.ID)
+	script, err := tracerScriptFor(customScript)
+	if err != nil {
+		log.Warning.Print(err)
+		return err
+	}
+
+	// One session (and one budget) for the whole event, not one per hook
+	// call, so a document with many tracer hits can't multiply the budget
+	// out to an effectively unbounded total.
+	sess, err := newScriptSession(script, DefaultScoreBudget)
+	if err != nil {
+		log.Warning.Print(err)
+		return err
+	}
+	defer sess.Close()
+
 	// Find all instances of the string string and record their appropriate contexts.
-	getTracerLocation(doc, &contexts, tracer.TracerPayload, *event, sevp)
+	getTracerLocation(doc, &contexts, tracer.TracerPayload, *event, sevp, sess, topCallOnly)
+
+	// Give the script a last chance to adjust or drop contexts once the
+	// whole document has been walked.
+	contexts = sess.runFinalize(contexts)
+	recordDOMContexts(span, contexts)
 
 	if len(contexts) == 0 {
 		return nil
@@ -158,17 +225,27 @@ func getDOMContexts(event *types.TracerEvent, tracer types.Tracer) error {
 		c.OverallSeverity = *sevp
 
 		// Also, increase the tracer event length by 1
+		_, dbSpan := startDBSpan(ctx, "Update", "tracers")
 		err = store.DB.Model(&c).Updates(map[string]interface{}{
 			"overall_severity": *sevp,
 		}).Error
+		if err != nil {
+			dbSpan.RecordError(err)
+		}
+		dbSpan.End()
 		newSev = true
 	}
 
 	// If we used to have no events, change that now.
 	if !old {
+		_, dbSpan := startDBSpan(ctx, "Update", "tracers")
 		err = store.DB.Model(&c).Updates(map[string]interface{}{
 			"has_tracer_events": tracer.HasTracerEvents,
 		}).Error
+		if err != nil {
+			dbSpan.RecordError(err)
+		}
+		dbSpan.End()
 	}
 
 	// If we updated the severity or got our first event, update the clients
@@ -180,13 +257,20 @@ func getDOMContexts(event *types.TracerEvent, tracer types.Tracer) error {
 	return err
 }
 
+// topCallOnlySeverity is the severity at or above which, when a tracer is
+// configured with topCallOnly, traversal stops looking for additional
+// contexts. This bounds cost on very large responses once we already know
+// the event is interesting.
+const topCallOnlySeverity = 3
+
 // Helper function that recursively traverses the DOM nodes and records any context
-// surrounding a particular string.
-// TODO: consider moving the severity rating stuff out of this function so we can
-// clean it up a bit.
-func getTracerLocation(n *html.Node, tracerLocations *[]types.DOMContext, tracer string, tracerEvent types.TracerEvent, highest *uint) {
-	var sev uint
-	var reason uint
+// surrounding a particular string. The severity/reason for each occurrence is
+// decided by the configured scoring script (see scoring.go); sess runs the
+// built-in default unless a custom script has been set for the tracer.
+func getTracerLocation(n *html.Node, tracerLocations *[]types.DOMContext, tracer string, tracerEvent types.TracerEvent, highest *uint, sess *scriptSession, topCallOnly bool) {
+	if topCallOnly && *highest >= topCallOnlySeverity {
+		return
+	}
 
 	// Just in case the HTML doesn't have a parent, we don't want to dereference a
 	// a nil pointer
@@ -196,125 +280,126 @@ func getTracerLocation(n *html.Node, tracerLocations *[]types.DOMContext, tracer
 		}
 	}
 	if strings.Contains(n.Data, tracer) {
+		var (
+			hookName string
+			loc      uint
+		)
 		if n.Type == html.TextNode {
-			*tracerLocations = append(*tracerLocations,
-				types.DOMContext{
-					TracerEventID:    tracerEvent.ID,
-					HTMLNodeType:     n.Parent.Data,
-					HTMLLocationType: types.Text,
-					EventContext:     gohtml.Format(n.Data),
-					Severity:         sev,
-					Reason:           types.LeafNode,
-				})
+			hookName, loc = "onText", types.Text
 		} else if n.Type == html.DocumentNode || n.Type == html.ElementNode || n.Type == html.DoctypeNode {
-			if n.Parent.Data == "script" {
-				if tracerEvent.EventType != "response" {
-					sev = 1
-					reason = types.LeafNodeScriptTag
-				}
-			}
+			hookName, loc = "onElement", types.NodeName
+		} else {
+			hookName, loc = "onText", types.Comment
+		}
 
-			// Element nodes .Data text is the tag name. If we have a tracer in the tag
-			// name and its not in the HTTP response, its vulnerable to XSS.
-			if n.Type == html.ElementNode {
-				if tracerEvent.EventType != "response" {
-					sev = 3
-					reason = types.TagName
-				}
-			}
+		res, err := sess.runHook(hookName, ScoreContext{
+			NodeType:  n.Data,
+			ParentTag: n.Parent.Data,
+			Tracer:    tracer,
+			EventType: tracerEvent.EventType,
+			Snippet:   n.Data,
+		})
+		if err != nil {
+			log.Warning.Print(err)
+		}
 
+		if !res.Skip {
 			*tracerLocations = append(*tracerLocations,
 				types.DOMContext{
 					TracerEventID:    tracerEvent.ID,
 					HTMLNodeType:     n.Parent.Data,
-					HTMLLocationType: types.NodeName,
-					EventContext:     gohtml.Format(n.Data),
-					Severity:         sev,
-					Reason:           reason,
-				})
-		} else {
-			// TODO: although, we should care about these cases, there could be a
-			// case where the comment could be broken out of
-			if tracerEvent.EventType != "response" {
-				sev = 1
-			}
-			*tracerLocations = append(*tracerLocations,
-				types.DOMContext{
-					TracerEventID:    tracerEvent.ID,
-					HTMLNodeType:     n.Parent.Data,
-					HTMLLocationType: types.Comment,
+					HTMLLocationType: loc,
 					EventContext:     gohtml.Format(n.Data),
-					Severity:         sev,
-					Reason:           types.LeafNodeCommentTag,
+					Severity:         res.Severity,
+					Reason:           res.Reason,
 				})
 		}
 
-		if sev > *highest {
-			*highest = sev
+		if res.Severity > *highest {
+			*highest = res.Severity
 		}
 	}
 
 	for _, a := range n.Attr {
 		if strings.Contains(a.Key, tracer) {
-			if tracerEvent.EventType != "response" {
-				sev = 3
-				reason = types.AttributeName
-			} else {
-				sev = 1
-				reason = types.AttributeNameHTTPResponse
+			res, err := sess.runHook("onAttr", ScoreContext{
+				NodeType:  n.Data,
+				AttrKey:   a.Key,
+				AttrVal:   a.Val,
+				Tracer:    tracer,
+				EventType: tracerEvent.EventType,
+			})
+			if err != nil {
+				log.Warning.Print(err)
 			}
 
-			*tracerLocations = append(*tracerLocations,
-				types.DOMContext{
-					TracerEventID:    tracerEvent.ID,
-					HTMLNodeType:     n.Data,
-					HTMLLocationType: types.Attr,
-					EventContext:     a.Val,
-					Severity:         sev,
-					Reason:           reason,
-				})
+			if !res.Skip {
+				*tracerLocations = append(*tracerLocations,
+					types.DOMContext{
+						TracerEventID:    tracerEvent.ID,
+						HTMLNodeType:     n.Data,
+						HTMLLocationType: types.Attr,
+						EventContext:     a.Val,
+						Severity:         res.Severity,
+						Reason:           res.Reason,
+					})
+			}
+
+			if res.Severity > *highest {
+				*highest = res.Severity
+			}
 		} else if strings.Contains(a.Val, tracer) {
-			// By default, user-input inside an attribute value is interesting.
-			sev = 1
-			reason = types.AttributeValueHTTPResponse
-			// HTTP responses don't mean as much.
-			if tracerEvent.EventType != "response" {
-				// If the href starts with a tracer string, need to look for JavaScript:
-				if a.Key == "href" && strings.HasPrefix(a.Val, tracer) {
-					sev = 2
-					reason = types.AttributeValueStartHref
-				} else if strings.HasPrefix(a.Key, "on") {
-					// for on handlers, these are very interesting
-					sev = 2
-					reason = types.AttributeValueOnEventHandler
-				}
+			res, err := sess.runHook("onAttrVal", ScoreContext{
+				NodeType:  n.Data,
+				AttrKey:   a.Key,
+				AttrVal:   a.Val,
+				Tracer:    tracer,
+				EventType: tracerEvent.EventType,
+			})
+			if err != nil {
+				log.Warning.Print(err)
 			}
 
-			*tracerLocations = append(*tracerLocations,
-				types.DOMContext{
-					TracerEventID:    tracerEvent.ID,
-					HTMLNodeType:     n.Data,
-					HTMLLocationType: types.AttrVal,
-					EventContext:     a.Val,
-					Severity:         sev,
-					Reason:           reason,
-				})
-		}
+			if !res.Skip {
+				*tracerLocations = append(*tracerLocations,
+					types.DOMContext{
+						TracerEventID:    tracerEvent.ID,
+						HTMLNodeType:     n.Data,
+						HTMLLocationType: types.AttrVal,
+						EventContext:     a.Val,
+						Severity:         res.Severity,
+						Reason:           res.Reason,
+					})
+			}
 
-		if sev > *highest {
-			*highest = sev
+			if res.Severity > *highest {
+				*highest = res.Severity
+			}
 		}
 	}
 
 	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		getTracerLocation(c, tracerLocations, tracer, tracerEvent, highest)
+		getTracerLocation(c, tracerLocations, tracer, tracerEvent, highest, sess, topCallOnly)
 	}
 }
 
 // AddEventData adds a raw event if it's the first of that type of event,
-// Otherwise, it returns the first event that looks like it. It also tags
-// the raw data as either HTML or JSON.
+// Otherwise, it returns the first event that looks like it. It infers the
+// format from the original JSON/HTML sniff, with no Content-Type header to
+// go on. Callers that have a Content-Type header available should use
+// AddEventDataWithContentType instead so e.g. XML/JS/CSS bodies get parsed
+// as their own format instead of falling back to HTML.
 func AddEventData(eventData string) (types.RawEvent, error) {
+	return AddEventDataWithContentType(eventData, "", nil)
+}
+
+// AddEventDataWithContentType is AddEventData plus an optional contentType
+// and the originating request's headers, used to pick the right format
+// handler instead of only ever guessing HTML vs JSON. contentType and
+// headers are optional; when contentType is empty, the format is inferred
+// from headers, falling back to the original JSON/HTML sniff if neither is
+// available.
+func AddEventDataWithContentType(eventData, contentType string, headers http.Header) (types.RawEvent, error) {
 	var (
 		re  types.RawEvent
 		err error
@@ -322,14 +407,25 @@ func AddEventData(eventData string) (types.RawEvent, error) {
 		f   uint
 	)
 
-	// Test if data is HTML or JSON by attempting to unmarshal the string as a
-	// JSON string. If it fails, it is most likely HTML.
-	// TODO: might be good in the future to infer from the content type
-	// TODO: header.
-	if ok := json.Valid([]byte(eventData)); !ok {
+	start := time.Now()
+	ctx, span := startSpan(context.Background(), "AddEventData", 0, eventData, "")
+	defer func() {
+		rawEventDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	if contentType == "" {
+		contentType = headerContentType(headers)
+	}
+	f = formatFromContentType(contentType, eventData)
+
+	switch f {
+	case types.HTML:
 		e = gohtml.Format(eventData)
-		f = types.HTML
-	} else {
+	case types.JSON:
 		var ind []byte
 		ind, err = json.MarshalIndent(eventData, "", "  ")
 		if err != nil {
@@ -337,11 +433,20 @@ func AddEventData(eventData string) (types.RawEvent, error) {
 			return re, err
 		}
 		e = string(ind)
-		f = types.JSON
+	default:
+		// XML, JS, CSS, and plain text are stored as-is; their format
+		// handlers work directly off the raw body.
+		e = eventData
 	}
 
 	// We need to check if the data is already there.
-	if err = store.DB.FirstOrCreate(&re, types.RawEvent{Data: e, Format: f}).Error; err != nil {
+	_, dbSpan := startDBSpan(ctx, "FirstOrCreate", "raw_events")
+	err = store.DB.FirstOrCreate(&re, types.RawEvent{Data: e, Format: f}).Error
+	if err != nil {
+		dbSpan.RecordError(err)
+	}
+	dbSpan.End()
+	if err != nil {
 		log.Warning.Printf("Wasn't able to create a raw event: %+v", re)
 		return re, err
 	}
@@ -355,7 +460,11 @@ func getTracerEventsDB(tracerID uint) ([]types.TracerEvent, error) {
 		tracerEvents []types.TracerEvent
 	)
 
+	_, span := startSpan(context.Background(), "getTracerEventsDB", tracerID, "", "")
+	defer span.End()
+
 	if err = store.DB.Preload("DOMContexts").Find(&tracerEvents, "tracer_id = ?", tracerID).Error; err != nil {
+		span.RecordError(err)
 		log.Warning.Print(err)
 		return nil, err
 	}
@@ -371,6 +480,13 @@ func getTracerEventsDB(tracerID uint) ([]types.TracerEvent, error) {
 			// Add the event to the cache so we don't have to look it up again.
 			cache[k] = rawTracerEvent
 		}
+
+		props, err := loadEventProperties(v.ID)
+		if err != nil {
+			log.Warning.Print(err)
+			continue
+		}
+		tracerEvents[k].Properties = props
 	}
 
 	return tracerEvents, nil
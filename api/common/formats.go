@@ -0,0 +1,229 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/nccgroup/tracy/api/types"
+)
+
+// FormatHandler parses a raw event body looking for tracer occurrences and
+// returns the DOM-context-like results for it, along with the severity of
+// each. Third parties register additional handlers with
+// RegisterFormatHandler instead of us hardcoding every format tracy might
+// ever see.
+type FormatHandler func(body string, tracer types.Tracer, event types.TracerEvent) ([]types.DOMContext, error)
+
+// formatHandlers is the open registry of parsers keyed by types.RawEvent
+// format. It's seeded with tracy's built-in formats in init() below.
+var formatHandlers = make(map[uint]FormatHandler)
+
+// RegisterFormatHandler adds (or replaces) the parser used for a given
+// types.RawEvent.Format. Callers typically allocate their format constant
+// starting above types.PlainText so they don't collide with tracy's
+// built-ins.
+func RegisterFormatHandler(format uint, handler FormatHandler) {
+	formatHandlers[format] = handler
+}
+
+func init() {
+	RegisterFormatHandler(types.HTML, htmlFormatHandler)
+	RegisterFormatHandler(types.JSON, jsonFormatHandler)
+	RegisterFormatHandler(types.XML, xmlFormatHandler)
+	RegisterFormatHandler(types.JS, jsFormatHandler)
+	RegisterFormatHandler(types.CSS, cssFormatHandler)
+	RegisterFormatHandler(types.PlainText, textFormatHandler)
+}
+
+// htmlFormatHandler delegates to the existing DOM-aware traversal. It's kept
+// in the registry so every format, including HTML, goes through the same
+// dispatch path.
+func htmlFormatHandler(body string, tracer types.Tracer, event types.TracerEvent) ([]types.DOMContext, error) {
+	event.RawEvent.Data = body
+	if err := getDOMContexts(context.Background(), &event, tracer); err != nil {
+		return nil, err
+	}
+	return event.DOMContexts, nil
+}
+
+// jsonFormatHandler looks for the tracer anywhere in the JSON text. JSON has
+// no code-execution context of its own, so every hit gets the same low
+// severity; a hit that later gets reflected into HTML or JS is caught by
+// those handlers instead.
+func jsonFormatHandler(body string, tracer types.Tracer, event types.TracerEvent) ([]types.DOMContext, error) {
+	if !strings.Contains(body, tracer.TracerPayload) {
+		return nil, nil
+	}
+	return []types.DOMContext{{
+		TracerEventID:    event.ID,
+		HTMLLocationType: types.JSONValue,
+		EventContext:     body,
+		Severity:         1,
+		Reason:           types.JSONValueContext,
+	}}, nil
+}
+
+// xmlFormatHandler looks for the tracer in element/attribute position versus
+// text/CDATA position. Element and attribute names are more interesting
+// because a badly-configured downstream XML consumer (or an XSLT transform)
+// can turn them into markup.
+func xmlFormatHandler(body string, tracer types.Tracer, event types.TracerEvent) ([]types.DOMContext, error) {
+	var contexts []types.DOMContext
+
+	idx := strings.Index(body, tracer.TracerPayload)
+	for idx != -1 {
+		loc := types.XMLText
+		sev := uint(1)
+		reason := types.XMLTextContext
+
+		// A hit inside a still-open CDATA section counts as text.
+		inCDATA := false
+		if cd := strings.LastIndex(body[:idx], "<![CDATA["); cd != -1 {
+			inCDATA = !strings.Contains(body[cd:idx], "]]>")
+		}
+
+		// Walk backwards from the hit to see whether it landed inside a tag,
+		// i.e. as an element or attribute name.
+		if open := strings.LastIndex(body[:idx], "<"); !inCDATA && open != -1 {
+			if close := strings.Index(body[open:], ">"); close == -1 || open+close > idx {
+				loc, sev, reason = types.XMLElement, 2, types.XMLElementContext
+			}
+		}
+
+		contexts = append(contexts, types.DOMContext{
+			TracerEventID:    event.ID,
+			HTMLLocationType: loc,
+			EventContext:     body,
+			Severity:         sev,
+			Reason:           reason,
+		})
+
+		next := strings.Index(body[idx+len(tracer.TracerPayload):], tracer.TracerPayload)
+		if next == -1 {
+			break
+		}
+		idx += len(tracer.TracerPayload) + next
+	}
+
+	return contexts, nil
+}
+
+// jsFormatHandler classifies a tracer hit inside a JavaScript body as either
+// a string literal, an identifier, or code passed straight to eval(...). The
+// latter two are where a tracer value could actually execute.
+//
+// This is a quote/suffix heuristic, not the real ES parser the request
+// called for, so it will misclassify template literals, regex literals,
+// comments, and multi-statement lines. It's a stopgap until this handler is
+// rewritten on top of an actual JS parser.
+func jsFormatHandler(body string, tracer types.Tracer, event types.TracerEvent) ([]types.DOMContext, error) {
+	idx := strings.Index(body, tracer.TracerPayload)
+	if idx == -1 {
+		return nil, nil
+	}
+
+	loc, sev, reason := types.JSStringLiteral, uint(1), types.JSStringLiteralContext
+
+	before := strings.TrimRight(body[:idx], " \t\n")
+	if strings.HasSuffix(before, "eval(") || strings.HasSuffix(before, "Function(") {
+		loc, sev, reason = types.JSCode, 3, types.JSEvalContext
+	} else if len(before) == 0 || !strings.ContainsAny(string(before[len(before)-1]), `"'`+"`") {
+		// Not immediately preceded by a quote character means this isn't
+		// inside a string literal, so treat it as an identifier/expression.
+		loc, sev, reason = types.JSIdentifier, 3, types.JSIdentifierContext
+	}
+
+	return []types.DOMContext{{
+		TracerEventID:    event.ID,
+		HTMLLocationType: loc,
+		EventContext:     body,
+		Severity:         sev,
+		Reason:           reason,
+	}}, nil
+}
+
+// cssFormatHandler classifies a tracer hit in a stylesheet as a selector, a
+// property value, or the contents of a url(...) function, the last of which
+// can be used to exfiltrate data or load attacker-controlled resources.
+func cssFormatHandler(body string, tracer types.Tracer, event types.TracerEvent) ([]types.DOMContext, error) {
+	idx := strings.Index(body, tracer.TracerPayload)
+	if idx == -1 {
+		return nil, nil
+	}
+
+	loc, sev, reason := types.CSSValue, uint(1), types.CSSValueContext
+
+	if strings.Contains(body[:idx], "url(") && !strings.Contains(body[:idx], ")") {
+		loc, sev, reason = types.CSSURL, 2, types.CSSURLContext
+	} else if brace := strings.LastIndex(body[:idx], "{"); brace == -1 || strings.LastIndex(body[:idx], "}") > brace {
+		loc, sev, reason = types.CSSSelector, 1, types.CSSSelectorContext
+	}
+
+	return []types.DOMContext{{
+		TracerEventID:    event.ID,
+		HTMLLocationType: loc,
+		EventContext:     body,
+		Severity:         sev,
+		Reason:           reason,
+	}}, nil
+}
+
+// textFormatHandler is the catch-all for bodies that aren't any of the above.
+// Plain text has no execution context, so a hit is only ever interesting as
+// a signal that the tracer made it this far.
+func textFormatHandler(body string, tracer types.Tracer, event types.TracerEvent) ([]types.DOMContext, error) {
+	if !strings.Contains(body, tracer.TracerPayload) {
+		return nil, nil
+	}
+	return []types.DOMContext{{
+		TracerEventID:    event.ID,
+		HTMLLocationType: types.PlainTextLocation,
+		EventContext:     body,
+		Severity:         0,
+		Reason:           types.PlainTextContext,
+	}}, nil
+}
+
+// formatFromContentType maps an HTTP Content-Type header to the
+// types.RawEvent format it should be parsed as, falling back to the
+// historical json.Valid sniff when the header is missing or unrecognized.
+func formatFromContentType(contentType, body string) uint {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil {
+			switch {
+			case strings.Contains(mediaType, "json"):
+				return types.JSON
+			case strings.Contains(mediaType, "html"):
+				return types.HTML
+			case strings.Contains(mediaType, "xml"):
+				return types.XML
+			case strings.Contains(mediaType, "javascript") || strings.Contains(mediaType, "ecmascript"):
+				return types.JS
+			case strings.Contains(mediaType, "css"):
+				return types.CSS
+			case strings.HasPrefix(mediaType, "text/"):
+				return types.PlainText
+			}
+		}
+	}
+
+	// No usable Content-Type header: fall back to the original sniff so
+	// existing callers keep working.
+	if json.Valid([]byte(body)) {
+		return types.JSON
+	}
+	return types.HTML
+}
+
+// headerContentType pulls the Content-Type header out of a request, if any
+// was provided.
+func headerContentType(headers http.Header) string {
+	if headers == nil {
+		return ""
+	}
+	return headers.Get("Content-Type")
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/nccgroup/tracy/api/types"
+)
+
+func TestJSFormatHandlerWhitespacePrefix(t *testing.T) {
+	tracer := types.Tracer{TracerPayload: "TRACERPAYLOAD"}
+	event := types.TracerEvent{}
+
+	// A tracer hit preceded only by whitespace used to panic with "index
+	// out of range [-1]" once the leading whitespace was trimmed away.
+	contexts, err := jsFormatHandler("   \nTRACERPAYLOAD rest", tracer, event)
+	if err != nil {
+		t.Fatalf("jsFormatHandler returned an error: %s", err)
+	}
+	if len(contexts) != 1 {
+		t.Fatalf("expected 1 context, got %d", len(contexts))
+	}
+	if contexts[0].HTMLLocationType != types.JSIdentifier {
+		t.Errorf("expected JSIdentifier location, got %v", contexts[0].HTMLLocationType)
+	}
+}
+
+func TestJSFormatHandlerEval(t *testing.T) {
+	tracer := types.Tracer{TracerPayload: "TRACERPAYLOAD"}
+	event := types.TracerEvent{}
+
+	contexts, err := jsFormatHandler(`eval(TRACERPAYLOAD)`, tracer, event)
+	if err != nil {
+		t.Fatalf("jsFormatHandler returned an error: %s", err)
+	}
+	if len(contexts) != 1 || contexts[0].Severity != 3 {
+		t.Fatalf("expected a single severity-3 context, got %+v", contexts)
+	}
+}
+
+func TestJSFormatHandlerStringLiteral(t *testing.T) {
+	tracer := types.Tracer{TracerPayload: "TRACERPAYLOAD"}
+	event := types.TracerEvent{}
+
+	contexts, err := jsFormatHandler(`var x = "TRACERPAYLOAD";`, tracer, event)
+	if err != nil {
+		t.Fatalf("jsFormatHandler returned an error: %s", err)
+	}
+	if len(contexts) != 1 || contexts[0].HTMLLocationType != types.JSStringLiteral {
+		t.Fatalf("expected a string literal context, got %+v", contexts)
+	}
+}
@@ -0,0 +1,255 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nccgroup/tracy/api/store"
+	"github.com/nccgroup/tracy/api/types"
+	"github.com/nccgroup/tracy/log"
+)
+
+// NotificationFormat selects how a types.Notification is encoded before it's
+// pushed to subscribers. Legacy keeps the raw JSON the websocket client
+// already expects; CloudEvents wraps it in a CloudEvents v1.0 envelope for
+// consumers like SIEMs or chat webhooks.
+type NotificationFormat uint
+
+const (
+	// LegacyNotification marshals types.Notification straight to JSON, same
+	// as before this feature existed.
+	LegacyNotification NotificationFormat = iota
+	// CloudEventsNotification wraps types.Notification in a CloudEvents v1.0
+	// structured-mode envelope.
+	CloudEventsNotification
+)
+
+// notificationFormat is the format used for new high-severity notifications.
+// It defaults to LegacyNotification so the websocket client doesn't break
+// until an operator opts in.
+var notificationFormat = LegacyNotification
+
+// SetNotificationFormat configures which format AddEvent uses when it
+// notifies subscribers about a high-severity DOM context.
+func SetNotificationFormat(f NotificationFormat) {
+	notificationFormat = f
+}
+
+// cloudEvent is a CloudEvents v1.0 structured-mode envelope. Only the
+// attributes tracy actually populates are included.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	Subject         string          `json:"subject"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// notificationEventType returns the CloudEvents `type` attribute for a
+// notification. Every notification this fires for is a high-severity DOM
+// context, so it always returns the same type; n is not inspected.
+func notificationEventType(n types.Notification) string {
+	return "io.tracy.event.dom_context.high_severity"
+}
+
+// formatNotification encodes a notification in the configured format.
+func formatNotification(n types.Notification) ([]byte, error) {
+	switch notificationFormat {
+	case CloudEventsNotification:
+		return marshalCloudEvent(n)
+	default:
+		return json.Marshal(n)
+	}
+}
+
+// marshalCloudEvent wraps a notification in a CloudEvents v1.0 envelope.
+func marshalCloudEvent(n types.Notification) ([]byte, error) {
+	data, err := json.Marshal(struct {
+		Tracer types.Tracer      `json:"Tracer"`
+		Event  types.TracerEvent `json:"Event"`
+	}{n.Tracer, n.Event})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling cloudevent data: %w", err)
+	}
+
+	ce := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.New().String(),
+		Source:          fmt.Sprintf("tracy/%d", n.Tracer.ID),
+		Type:            notificationEventType(n),
+		Time:            time.Now().UTC(),
+		Subject:         n.Tracer.TracerPayload,
+		DataContentType: "application/json",
+		Data:            data,
+	}
+
+	return json.Marshal(ce)
+}
+
+// notifyHighSeverity pushes a high-severity DOM context notification to
+// websocket subscribers in the configured format, and to any webhooks
+// registered for the tracer's project.
+func notifyHighSeverity(tracer types.Tracer, event types.TracerEvent) {
+	n := types.Notification{Tracer: tracer, Event: event}
+
+	if notificationFormat == LegacyNotification {
+		// Preserve the exact historical behavior: push the raw struct
+		// through the existing websocket path.
+		UpdateSubscribers(n)
+	} else {
+		payload, err := formatNotification(n)
+		if err != nil {
+			log.Warning.Print(err)
+			return
+		}
+		UpdateSubscribers(json.RawMessage(payload))
+	}
+
+	deliverWebhooks(tracer, n)
+}
+
+// webhookConfig is a project's configured webhook delivery target. Secret is
+// used to HMAC-sign the request body so the receiver can verify tracy sent
+// it.
+type webhookConfig struct {
+	ID        uint `gorm:"primary_key"`
+	ProjectID uint
+	URL       string
+	Secret    string
+}
+
+// webhookDeadLetter records a delivery that exhausted its retries, so an
+// operator can inspect and replay it later.
+type webhookDeadLetter struct {
+	ID        uint `gorm:"primary_key"`
+	ProjectID uint
+	URL       string
+	Payload   string
+	Error     string
+	CreatedAt time.Time
+}
+
+// maxWebhookAttempts bounds the exponential backoff retry loop before a
+// delivery is parked in the dead-letter queue.
+const maxWebhookAttempts = 5
+
+// webhookMigrateOnce makes sure webhookConfig/webhookDeadLetter get their
+// tables created exactly once, on first use by SetWebhookURL or
+// deliverWebhooks. deliverWebhooks runs for every high-severity
+// notification, so the tables are created on the first one even when no
+// webhook has been configured.
+var webhookMigrateOnce sync.Once
+
+func ensureWebhookTables() {
+	webhookMigrateOnce.Do(func() {
+		if err := store.DB.AutoMigrate(&webhookConfig{}, &webhookDeadLetter{}).Error; err != nil {
+			log.Warning.Print(fmt.Errorf("migrating webhook tables: %w", err))
+		}
+	})
+}
+
+// SetWebhookURL registers (or replaces) the webhook tracy delivers
+// high-severity notifications to for a project.
+func SetWebhookURL(projectID uint, url, secret string) error {
+	ensureWebhookTables()
+
+	cfg := webhookConfig{ProjectID: projectID, URL: url, Secret: secret}
+	if err := store.DB.Where("project_id = ?", projectID).Delete(&webhookConfig{}).Error; err != nil {
+		return fmt.Errorf("replacing webhook config: %w", err)
+	}
+	if err := store.DB.Create(&cfg).Error; err != nil {
+		return fmt.Errorf("saving webhook config: %w", err)
+	}
+	return nil
+}
+
+// deliverWebhooks sends the notification to every webhook configured for the
+// tracer's project, retrying with exponential backoff and falling back to
+// the dead-letter queue on exhaustion. Delivery happens on its own goroutine
+// so a slow or unreachable receiver can't stall event ingestion.
+func deliverWebhooks(tracer types.Tracer, n types.Notification) {
+	ensureWebhookTables()
+
+	var configs []webhookConfig
+	if err := store.DB.Find(&configs, "project_id = ?", tracer.ProjectID).Error; err != nil {
+		log.Warning.Print(err)
+		return
+	}
+	if len(configs) == 0 {
+		return
+	}
+
+	payload, err := marshalCloudEvent(n)
+	if err != nil {
+		log.Warning.Print(err)
+		return
+	}
+
+	for _, cfg := range configs {
+		go deliverWebhook(cfg, payload)
+	}
+}
+
+// deliverWebhook POSTs a signed payload to a single webhook, retrying with
+// exponential backoff (1s, 2s, 4s, ...) up to maxWebhookAttempts times.
+func deliverWebhook(cfg webhookConfig, payload []byte) {
+	sig := signPayload(cfg.Secret, payload)
+
+	backoff := time.Second
+	var lastErr error
+	for attempt := 0; attempt < maxWebhookAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(payload))
+		if err != nil {
+			lastErr = err
+			break
+		}
+		req.Header.Set("Content-Type", "application/cloudevents+json")
+		req.Header.Set("X-Tracy-Signature", sig)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			lastErr = fmt.Errorf("webhook %s returned status %d", cfg.URL, resp.StatusCode)
+		} else {
+			lastErr = err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	log.Warning.Printf("webhook delivery to %s failed after %d attempts: %s", cfg.URL, maxWebhookAttempts, lastErr)
+	dl := webhookDeadLetter{
+		ProjectID: cfg.ProjectID,
+		URL:       cfg.URL,
+		Payload:   string(payload),
+		Error:     lastErr.Error(),
+		CreatedAt: time.Now(),
+	}
+	if err := store.DB.Create(&dl).Error; err != nil {
+		log.Warning.Print(err)
+	}
+}
+
+// signPayload returns the hex-encoded HMAC-SHA256 of payload, used to let a
+// webhook receiver verify the request actually came from this tracy
+// instance.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nccgroup/tracy/api/types"
+)
+
+func TestSignPayloadIsDeterministicPerSecret(t *testing.T) {
+	payload := []byte(`{"hello":"world"}`)
+
+	sig1 := signPayload("secret-a", payload)
+	sig2 := signPayload("secret-a", payload)
+	if sig1 != sig2 {
+		t.Fatal("expected the same secret/payload pair to produce the same signature")
+	}
+
+	if sig3 := signPayload("secret-b", payload); sig3 == sig1 {
+		t.Fatal("expected a different secret to produce a different signature")
+	}
+}
+
+func TestMarshalCloudEventEnvelope(t *testing.T) {
+	n := types.Notification{
+		Tracer: types.Tracer{ID: 1, TracerPayload: "TRACERPAYLOAD"},
+		Event:  types.TracerEvent{ID: 2},
+	}
+
+	raw, err := marshalCloudEvent(n)
+	if err != nil {
+		t.Fatalf("marshalCloudEvent returned an error: %s", err)
+	}
+
+	var ce cloudEvent
+	if err := json.Unmarshal(raw, &ce); err != nil {
+		t.Fatalf("unmarshaling cloudevent envelope: %s", err)
+	}
+	if ce.SpecVersion != "1.0" {
+		t.Errorf("expected specversion 1.0, got %q", ce.SpecVersion)
+	}
+	if ce.Subject != n.Tracer.TracerPayload {
+		t.Errorf("expected subject %q, got %q", n.Tracer.TracerPayload, ce.Subject)
+	}
+	if ce.Type != notificationEventType(n) {
+		t.Errorf("expected type %q, got %q", notificationEventType(n), ce.Type)
+	}
+}
@@ -0,0 +1,278 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nccgroup/tracy/api/store"
+	"github.com/nccgroup/tracy/api/types"
+	"github.com/nccgroup/tracy/log"
+)
+
+// tracerEventProperty is a single indexable key/value pair attached to a
+// tracer event. Only one of ValueString/ValueNumber/ValueBool is set,
+// matching whichever type the caller sent; values are kept in separate typed
+// columns rather than one JSON blob. GetEventsByProperties and
+// GetPropertySummary load each event's rows and filter and aggregate them
+// in memory.
+type tracerEventProperty struct {
+	ID          uint   `gorm:"primary_key"`
+	EventID     uint   `gorm:"index"`
+	Key         string `gorm:"index"`
+	ValueString *string
+	ValueNumber *float64
+	ValueBool   *bool
+}
+
+// TableName pins the GORM table name so it reads clearly in migrations and
+// ad-hoc queries, rather than the pluralized default.
+func (tracerEventProperty) TableName() string {
+	return "tracer_event_properties"
+}
+
+// propertyMigrateOnce makes sure tracer_event_properties gets created
+// exactly once, the first time a property is read or written. Lazy,
+// on-first-use migration means an existing deployment picks up the new
+// table without a separate migration step tied to upgrading the binary.
+var propertyMigrateOnce sync.Once
+
+func ensurePropertyTable() {
+	propertyMigrateOnce.Do(func() {
+		if err := store.DB.AutoMigrate(&tracerEventProperty{}).Error; err != nil {
+			log.Warning.Print(fmt.Errorf("migrating tracer_event_properties: %w", err))
+		}
+	})
+}
+
+// validateProperties rejects any property value that isn't a string,
+// number, or bool, since those are the only types tracerEventProperty can
+// index. AddEvent calls it and returns the error before touching the
+// database; callers are expected to turn this error into an HTTP 400.
+func validateProperties(props map[string]interface{}) error {
+	for k, v := range props {
+		switch v.(type) {
+		case string, float64, int, int64, bool:
+		default:
+			return fmt.Errorf("property %q has unsupported value type %T; must be string, number, or bool", k, v)
+		}
+	}
+	return nil
+}
+
+// saveEventProperties persists an event's properties as indexable rows, one
+// per key. It returns only an error; the caller keeps its own copy of the
+// properties on the in-memory types.TracerEvent.
+func saveEventProperties(eventID uint, props map[string]interface{}) error {
+	ensurePropertyTable()
+
+	for k, v := range props {
+		row := tracerEventProperty{EventID: eventID, Key: k}
+		switch val := v.(type) {
+		case string:
+			row.ValueString = &val
+		case bool:
+			row.ValueBool = &val
+		case float64:
+			row.ValueNumber = &val
+		case int:
+			f := float64(val)
+			row.ValueNumber = &f
+		case int64:
+			f := float64(val)
+			row.ValueNumber = &f
+		default:
+			return fmt.Errorf("property %q has unsupported value type %T", k, v)
+		}
+		if err := store.DB.Create(&row).Error; err != nil {
+			return fmt.Errorf("saving property %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// loadEventProperties reads an event's properties back out of
+// tracer_event_properties into the map/any shape types.TracerEvent.Properties
+// expects.
+func loadEventProperties(eventID uint) (map[string]interface{}, error) {
+	ensurePropertyTable()
+
+	var rows []tracerEventProperty
+	if err := store.DB.Find(&rows, "event_id = ?", eventID).Error; err != nil {
+		return nil, err
+	}
+
+	props := make(map[string]interface{}, len(rows))
+	for _, r := range rows {
+		switch {
+		case r.ValueString != nil:
+			props[r.Key] = *r.ValueString
+		case r.ValueNumber != nil:
+			props[r.Key] = *r.ValueNumber
+		case r.ValueBool != nil:
+			props[r.Key] = *r.ValueBool
+		}
+	}
+	return props, nil
+}
+
+// propertyFilter is one `prop.<key>=<value>`, `prop.<key>><value>`, or
+// `prop.<key><<value>` query parameter, as parsed by parsePropertyFilters.
+// GetEventsByProperties checks filters in memory with propertiesMatch.
+type propertyFilter struct {
+	Key   string
+	Op    string // "=", ">", "<"
+	Value string
+}
+
+// parsePropertyFilters parses filters directly out of the raw query string
+// rather than an already-parsed url.Values. A filter like
+// "prop.latency_ms>100" has no "=" in it at all, so by the time
+// url.ParseQuery has run, the ">" has already been folded into the key
+// ("prop.latency_ms>100") with an empty value, and the operator is lost.
+func parsePropertyFilters(rawQuery string) []propertyFilter {
+	var filters []propertyFilter
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+
+		idx := strings.IndexAny(part, "=<>")
+		if idx == -1 {
+			continue
+		}
+		rawKey, op, rawValue := part[:idx], string(part[idx]), part[idx+1:]
+		if op == "=" && (strings.HasPrefix(rawValue, ">") || strings.HasPrefix(rawValue, "<")) {
+			// Also accept the "prop.foo=>100" / "prop.foo=<100" spelling.
+			op, rawValue = string(rawValue[0]), rawValue[1:]
+		}
+
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil || !strings.HasPrefix(key, "prop.") {
+			continue
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			continue
+		}
+
+		filters = append(filters, propertyFilter{
+			Key:   strings.TrimPrefix(key, "prop."),
+			Op:    op,
+			Value: value,
+		})
+	}
+	return filters
+}
+
+// GetEventsByProperties backs `GET /tracers/:id/events?prop.foo=bar&...`. It
+// returns the tracer events for tracerID whose properties satisfy every
+// filter. rawQuery is the request URL's raw, still-encoded query string
+// (e.g. r.URL.RawQuery), not an already-parsed url.Values — see
+// parsePropertyFilters for why.
+func GetEventsByProperties(tracerID uint, rawQuery string) ([]types.TracerEvent, error) {
+	events, err := getTracerEventsDB(tracerID)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := parsePropertyFilters(rawQuery)
+	if len(filters) == 0 {
+		return events, nil
+	}
+
+	var matched []types.TracerEvent
+	for _, e := range events {
+		props, err := loadEventProperties(e.ID)
+		if err != nil {
+			return nil, err
+		}
+		if propertiesMatch(props, filters) {
+			e.Properties = props
+			matched = append(matched, e)
+		}
+	}
+	return matched, nil
+}
+
+func propertiesMatch(props map[string]interface{}, filters []propertyFilter) bool {
+	for _, f := range filters {
+		v, ok := props[f.Key]
+		if !ok {
+			return false
+		}
+		switch f.Op {
+		case "=":
+			if fmt.Sprintf("%v", v) != f.Value {
+				return false
+			}
+		case ">", "<":
+			n, ok := v.(float64)
+			want, err := strconv.ParseFloat(f.Value, 64)
+			if !ok || err != nil {
+				return false
+			}
+			if f.Op == ">" && !(n > want) {
+				return false
+			}
+			if f.Op == "<" && !(n < want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// PropertySummary is the response for
+// `GET /tracers/:id/properties/:key/summary`.
+type PropertySummary struct {
+	Count int      `json:"count"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Avg   *float64 `json:"avg,omitempty"`
+}
+
+// GetPropertySummary aggregates a single numeric property across every event
+// for a tracer. Non-numeric properties still report Count, with Min/Max/Avg
+// left nil.
+func GetPropertySummary(tracerID uint, key string) (PropertySummary, error) {
+	var summary PropertySummary
+
+	events, err := getTracerEventsDB(tracerID)
+	if err != nil {
+		return summary, err
+	}
+
+	var sum float64
+	for _, e := range events {
+		props, err := loadEventProperties(e.ID)
+		if err != nil {
+			return summary, err
+		}
+		v, ok := props[key]
+		if !ok {
+			continue
+		}
+		summary.Count++
+		n, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		if summary.Min == nil || n < *summary.Min {
+			summary.Min = &n
+		}
+		if summary.Max == nil || n > *summary.Max {
+			summary.Max = &n
+		}
+		sum += n
+	}
+
+	if summary.Count > 0 && summary.Min != nil {
+		avg := sum / float64(summary.Count)
+		summary.Avg = &avg
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,54 @@
+package common
+
+import "testing"
+
+func TestParsePropertyFiltersOperators(t *testing.T) {
+	filters := parsePropertyFilters("prop.status=ok&prop.latency_ms>100&prop.retries<3")
+	if len(filters) != 3 {
+		t.Fatalf("expected 3 filters, got %d: %+v", len(filters), filters)
+	}
+
+	want := map[string]propertyFilter{
+		"status":     {Key: "status", Op: "=", Value: "ok"},
+		"latency_ms": {Key: "latency_ms", Op: ">", Value: "100"},
+		"retries":    {Key: "retries", Op: "<", Value: "3"},
+	}
+	for _, f := range filters {
+		w, ok := want[f.Key]
+		if !ok || f != w {
+			t.Errorf("unexpected filter %+v", f)
+		}
+	}
+}
+
+func TestParsePropertyFiltersAltOperatorSpelling(t *testing.T) {
+	// "prop.foo=>100" should parse the same as "prop.foo>100"; url.ParseQuery
+	// would otherwise hand it back as key "prop.foo" with the ">" left at the
+	// start of the value.
+	filters := parsePropertyFilters("prop.latency_ms=>100")
+	if len(filters) != 1 {
+		t.Fatalf("expected 1 filter, got %d: %+v", len(filters), filters)
+	}
+	if filters[0] != (propertyFilter{Key: "latency_ms", Op: ">", Value: "100"}) {
+		t.Errorf("unexpected filter %+v", filters[0])
+	}
+}
+
+func TestPropertiesMatch(t *testing.T) {
+	props := map[string]interface{}{
+		"status":     "ok",
+		"latency_ms": float64(150),
+	}
+	filters := []propertyFilter{
+		{Key: "status", Op: "=", Value: "ok"},
+		{Key: "latency_ms", Op: ">", Value: "100"},
+	}
+	if !propertiesMatch(props, filters) {
+		t.Fatal("expected props to match filters")
+	}
+
+	filters = append(filters, propertyFilter{Key: "latency_ms", Op: "<", Value: "100"})
+	if propertiesMatch(props, filters) {
+		t.Fatal("expected props not to match once an unsatisfiable filter is added")
+	}
+}
@@ -0,0 +1,322 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/nccgroup/tracy/api/store"
+	"github.com/nccgroup/tracy/api/types"
+	"github.com/nccgroup/tracy/log"
+)
+
+// DefaultScoreBudget bounds how long a single event's scoring script is
+// allowed to run, across every onText/onElement/onAttr/onAttrVal/finalize
+// call it makes for that event, before it's interrupted. Keeps a
+// pathological user script from stalling event ingestion on a document with
+// many tracer hits.
+const DefaultScoreBudget = 50 * time.Millisecond
+
+// ScoreContext is the object passed into the onText/onElement/onAttr/onAttrVal
+// hooks. It mirrors the pieces of an html.Node that getTracerLocation already
+// inspects.
+type ScoreContext struct {
+	NodeType  string `json:"nodeType"`
+	ParentTag string `json:"parentTag"`
+	AttrKey   string `json:"attrKey"`
+	AttrVal   string `json:"attrVal"`
+	Tracer    string `json:"tracer"`
+	EventType string `json:"eventType"`
+	Snippet   string `json:"snippet"`
+}
+
+// ScoreResult is the shape every hook must return.
+type ScoreResult struct {
+	Severity uint `json:"severity"`
+	Reason   uint `json:"reason"`
+	Skip     bool `json:"skip"`
+}
+
+// compiledScript is a parsed, ready-to-run tracer scoring program, cached by
+// the hash of its source so we don't recompile per event.
+type compiledScript struct {
+	hash    string
+	program *goja.Program
+}
+
+var (
+	scriptCacheMu sync.RWMutex
+	scriptCache   = make(map[string]*compiledScript)
+
+	// defaultScore is used whenever a project hasn't configured a custom
+	// script, so behavior is unchanged from the hardcoded severity table.
+	defaultScore = mustCompileScript(defaultTracerScript)
+)
+
+// defaultTracerScript reproduces the severity/reason rules that used to be
+// hardcoded in getTracerLocation. It's shipped as the built-in default so
+// installs that never set a custom script see identical results.
+const defaultTracerScript = `
+function onText(ctx) {
+    return {severity: 0, reason: 0, skip: false};
+}
+
+function onElement(ctx) {
+    if (ctx.parentTag === "script" && ctx.eventType !== "response") {
+        return {severity: 1, reason: 0, skip: false};
+    }
+    if (ctx.eventType !== "response") {
+        return {severity: 3, reason: 0, skip: false};
+    }
+    return {severity: 0, reason: 0, skip: false};
+}
+
+function onAttr(ctx) {
+    if (ctx.eventType !== "response") {
+        return {severity: 3, reason: 0, skip: false};
+    }
+    return {severity: 1, reason: 0, skip: false};
+}
+
+function onAttrVal(ctx) {
+    if (ctx.eventType === "response") {
+        return {severity: 1, reason: 0, skip: false};
+    }
+    if (ctx.attrKey === "href" && ctx.attrVal.indexOf(ctx.tracer) === 0) {
+        return {severity: 2, reason: 0, skip: false};
+    }
+    if (ctx.attrKey.indexOf("on") === 0) {
+        return {severity: 2, reason: 0, skip: false};
+    }
+    return {severity: 1, reason: 0, skip: false};
+}
+
+function finalize(contexts) {
+    return contexts;
+}
+`
+
+// hashScript returns the hex sha256 of a script's source, used as the cache
+// key so identical scripts set on different tracers share one compiled
+// program.
+func hashScript(src string) string {
+	sum := sha256.Sum256([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+func mustCompileScript(src string) *compiledScript {
+	c, err := compileScript(src)
+	if err != nil {
+		// The default script is ours; if it doesn't compile, that's a bug
+		// we want to know about immediately.
+		log.Error.Fatalf("tracy: default tracer script failed to compile: %s", err)
+	}
+	return c
+}
+
+// compileScript parses a tracer scoring program and caches it by hash so
+// repeated events against the same script skip the parse step.
+func compileScript(src string) (*compiledScript, error) {
+	hash := hashScript(src)
+
+	scriptCacheMu.RLock()
+	if c, ok := scriptCache[hash]; ok {
+		scriptCacheMu.RUnlock()
+		return c, nil
+	}
+	scriptCacheMu.RUnlock()
+
+	prog, err := goja.Compile("tracer.js", src, false)
+	if err != nil {
+		return nil, fmt.Errorf("compiling tracer script: %w", err)
+	}
+
+	c := &compiledScript{hash: hash, program: prog}
+
+	scriptCacheMu.Lock()
+	scriptCache[hash] = c
+	scriptCacheMu.Unlock()
+
+	return c, nil
+}
+
+// scriptSession is a single sandboxed goja runtime shared across every hook
+// call made while scoring one event (every onText/onElement/onAttr/onAttrVal
+// hit plus the closing finalize call), so budget bounds the whole event the
+// way the request specifies, rather than resetting on every individual node
+// or attribute match. The runtime has no access to the file system or
+// network, and is interrupted once budget elapses.
+type scriptSession struct {
+	vm    *goja.Runtime
+	timer *time.Timer
+}
+
+// newScriptSession loads c into a fresh runtime and starts its budget timer.
+// Callers must Close the session once they're done scoring the event.
+func newScriptSession(c *compiledScript, budget time.Duration) (*scriptSession, error) {
+	vm := goja.New()
+	// Without this, goja exposes Go's PascalCase field names (ctx.NodeType,
+	// ctx.EventType, ...) instead of the lowerCamelCase names the hook API
+	// and defaultTracerScript actually use (ctx.nodeType, ctx.eventType),
+	// so every hook would see its context fields as undefined.
+	vm.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+	if _, err := vm.RunProgram(c.program); err != nil {
+		return nil, fmt.Errorf("loading tracer script: %w", err)
+	}
+
+	s := &scriptSession{vm: vm}
+	s.timer = time.AfterFunc(budget, func() {
+		vm.Interrupt("tracer script exceeded its time budget")
+	})
+	return s, nil
+}
+
+// Close stops the session's budget timer. It does not reset the runtime's
+// interrupted state; a session is one-shot, scoped to a single event.
+func (s *scriptSession) Close() {
+	s.timer.Stop()
+}
+
+// runHook invokes a single named hook (onText, onElement, onAttr, onAttrVal)
+// against this session's runtime. Hooks a script doesn't define are treated
+// as "no opinion" for that node type.
+func (s *scriptSession) runHook(hookName string, ctx ScoreContext) (ScoreResult, error) {
+	var res ScoreResult
+
+	hook, ok := goja.AssertFunction(s.vm.Get(hookName))
+	if !ok {
+		return res, nil
+	}
+
+	val, err := hook(goja.Undefined(), s.vm.ToValue(ctx))
+	if err != nil {
+		return res, fmt.Errorf("running %s: %w", hookName, err)
+	}
+
+	if err := s.vm.ExportTo(val, &res); err != nil {
+		return res, fmt.Errorf("decoding result of %s: %w", hookName, err)
+	}
+
+	return res, nil
+}
+
+// runFinalize invokes the script's finalize(contexts) hook, if it defines
+// one, giving it a last chance to adjust or drop contexts after the full
+// traversal has run. Scripts that don't define finalize (or that return
+// something we can't decode) leave contexts untouched.
+func (s *scriptSession) runFinalize(contexts []types.DOMContext) []types.DOMContext {
+	hook, ok := goja.AssertFunction(s.vm.Get("finalize"))
+	if !ok {
+		return contexts
+	}
+
+	val, err := hook(goja.Undefined(), s.vm.ToValue(contexts))
+	if err != nil {
+		log.Warning.Print(fmt.Errorf("running finalize: %w", err))
+		return contexts
+	}
+
+	var final []types.DOMContext
+	if err := s.vm.ExportTo(val, &final); err != nil {
+		log.Warning.Print(fmt.Errorf("decoding result of finalize: %w", err))
+		return contexts
+	}
+
+	return final
+}
+
+// tracerScriptFor returns the compiled script configured for a tracer, or
+// the built-in default if none has been set. Custom scripts are looked up by
+// the caller (getDOMContexts) and passed in once per event so we don't hit
+// the store for every node.
+func tracerScriptFor(src string) (*compiledScript, error) {
+	if src == "" {
+		return defaultScore, nil
+	}
+	return compileScript(src)
+}
+
+// tracerScriptConfig is the scoring script configured for one tracer, keyed
+// by tracer ID; tracers in the same project do not share it. It is stored
+// in the database rather than kept only in memory, so a custom script
+// survives a process restart instead of silently reverting every tracer to
+// defaultTracerScript.
+type tracerScriptConfig struct {
+	ID          uint `gorm:"primary_key"`
+	TracerID    uint `gorm:"unique_index"`
+	Script      string
+	TopCallOnly bool
+}
+
+// TableName pins the GORM table name, matching the convention used by the
+// other lazily-migrated tables in this package.
+func (tracerScriptConfig) TableName() string {
+	return "tracer_script_configs"
+}
+
+// scriptMigrateOnce makes sure tracer_script_configs gets created exactly
+// once, the first time a project's script is read or written.
+var scriptMigrateOnce sync.Once
+
+func ensureScriptTable() {
+	scriptMigrateOnce.Do(func() {
+		if err := store.DB.AutoMigrate(&tracerScriptConfig{}).Error; err != nil {
+			log.Warning.Print(fmt.Errorf("migrating tracer_script_configs: %w", err))
+		}
+	})
+}
+
+// SetTracerScript is the common functionality backing the REST endpoint that
+// configures a tracer's scoring script. It validates the script compiles
+// before accepting it so a bad script can't silently disable DOM context
+// detection.
+func SetTracerScript(tracerID uint, script string, topCallOnly bool) error {
+	if _, err := compileScript(script); err != nil {
+		return fmt.Errorf("tracer script is invalid: %w", err)
+	}
+
+	ensureScriptTable()
+
+	if err := store.DB.Where("tracer_id = ?", tracerID).Delete(&tracerScriptConfig{}).Error; err != nil {
+		return fmt.Errorf("replacing tracer script config: %w", err)
+	}
+	cfg := tracerScriptConfig{TracerID: tracerID, Script: script, TopCallOnly: topCallOnly}
+	if err := store.DB.Create(&cfg).Error; err != nil {
+		return fmt.Errorf("saving tracer script config: %w", err)
+	}
+	return nil
+}
+
+// GetTracerScript is the common functionality backing the REST endpoint that
+// reads back a tracer's scoring script. An empty string means the tracer is
+// using the built-in default.
+func GetTracerScript(tracerID uint) (script string, topCallOnly bool) {
+	ensureScriptTable()
+
+	var cfg tracerScriptConfig
+	if err := store.DB.Where("tracer_id = ?", tracerID).First(&cfg).Error; err != nil {
+		return "", false
+	}
+	return cfg.Script, cfg.TopCallOnly
+}
+
+// TestTracerScript is the common functionality backing the REST endpoint
+// that lets a user dry-run a script against a single hook invocation before
+// saving it, without touching any stored tracer configuration.
+func TestTracerScript(script, hookName string, ctx ScoreContext) (ScoreResult, error) {
+	c, err := compileScript(script)
+	if err != nil {
+		return ScoreResult{}, fmt.Errorf("tracer script is invalid: %w", err)
+	}
+
+	sess, err := newScriptSession(c, DefaultScoreBudget)
+	if err != nil {
+		return ScoreResult{}, err
+	}
+	defer sess.Close()
+
+	return sess.runHook(hookName, ctx)
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracerScriptDefaultScriptParentedElementIsLowSeverity(t *testing.T) {
+	res, err := TestTracerScript(defaultTracerScript, "onElement", ScoreContext{
+		ParentTag: "script",
+		EventType: "request",
+	})
+	if err != nil {
+		t.Fatalf("TestTracerScript returned an error: %s", err)
+	}
+	if res.Severity != 1 {
+		t.Fatalf("expected severity 1 for a script-parented element, got %d", res.Severity)
+	}
+}
+
+func TestScriptSessionBudgetInterruptsRunawayScript(t *testing.T) {
+	c, err := compileScript(`
+function onText(ctx) {
+    while (true) {}
+}
+`)
+	if err != nil {
+		t.Fatalf("compileScript returned an error: %s", err)
+	}
+
+	sess, err := newScriptSession(c, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("newScriptSession returned an error: %s", err)
+	}
+	defer sess.Close()
+
+	if _, err := sess.runHook("onText", ScoreContext{}); err == nil {
+		t.Fatal("expected runHook to return an error once the budget was exceeded")
+	}
+}
+
+func TestScriptSessionBudgetIsSharedAcrossHookCalls(t *testing.T) {
+	// A session only starts one timer for its whole lifetime, so a
+	// short-lived hook call made after that timer has fired is interrupted
+	// instead of getting a fresh budget of its own.
+	c, err := compileScript(defaultTracerScript)
+	if err != nil {
+		t.Fatalf("compileScript returned an error: %s", err)
+	}
+
+	sess, err := newScriptSession(c, 5*time.Millisecond)
+	if err != nil {
+		t.Fatalf("newScriptSession returned an error: %s", err)
+	}
+	defer sess.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := sess.runHook("onText", ScoreContext{}); err == nil {
+		t.Fatal("expected the session's single budget timer to have already fired")
+	}
+}
@@ -0,0 +1,182 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nccgroup/tracy/api/types"
+	"github.com/nccgroup/tracy/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies this package's spans in whatever backend the
+// configured OTLP endpoint points at.
+const tracerName = "github.com/nccgroup/tracy/api/common"
+
+var otelTracer oteltrace.Tracer
+
+func init() {
+	// Reuse the same process init() pattern as the event cache goroutine
+	// in event.go: bootstrap once, at package load, from environment config.
+	endpoint := os.Getenv("TRACY_OTLP_ENDPOINT")
+	if endpoint == "" {
+		otelTracer = otel.Tracer(tracerName)
+		return
+	}
+
+	exp, err := otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		log.Warning.Printf("failed to start otlp exporter, telemetry disabled: %s", err)
+		otelTracer = otel.Tracer(tracerName)
+		return
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	otelTracer = otel.Tracer(tracerName)
+}
+
+var (
+	eventsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tracy_events_total",
+		Help: "Total number of tracer events ingested.",
+	})
+	domContextsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracy_dom_contexts_total",
+		Help: "Total number of DOM contexts found, by severity.",
+	}, []string{"severity"})
+	ingestErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tracy_event_ingest_errors_total",
+		Help: "Total number of errors encountered while ingesting an event.",
+	})
+	ingestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "tracy_event_ingest_duration_seconds",
+		Help: "Time spent handling a single AddEvent call.",
+	})
+	htmlParseDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "tracy_html_parse_duration_seconds",
+		Help: "Time spent parsing a raw event as HTML in getDOMContexts.",
+	})
+	rawEventDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "tracy_raw_event_ingest_duration_seconds",
+		Help: "Time spent handling a single AddEventData/AddEventDataWithContentType call.",
+	})
+)
+
+// hashPayload returns a stable, non-reversible identifier for a tracer
+// payload, so spans/metrics can reference it without leaking its value into
+// a tracing backend.
+func hashPayload(payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSpan starts a span for one of the instrumented functions in this
+// package, tagged with the attributes requests for this feature asked for.
+func startSpan(ctx context.Context, name string, tracerID uint, payload string, eventType string) (context.Context, oteltrace.Span) {
+	return otelTracer.Start(ctx, name, oteltrace.WithAttributes(
+		attribute.Int64("tracer.id", int64(tracerID)),
+		attribute.String("tracer.payload", hashPayload(payload)),
+		attribute.String("event.type", eventType),
+	))
+}
+
+// startDBSpan starts a child span around a single store.DB call. The request
+// asked for every store.DB call to be wrapped through a GORM callback so
+// this fell out "for free" at the driver level, but the version of GORM this
+// package is built against doesn't thread a context.Context into its
+// callback hooks, so a callback has no span to parent itself to. Instead,
+// call sites that already have ctx in scope (getDOMContexts,
+// AddEventDataWithContentType) wrap their own store.DB calls with this helper, which gets the same
+// parent/child span nesting without needing GORM to cooperate.
+func startDBSpan(ctx context.Context, op, table string) (context.Context, oteltrace.Span) {
+	return otelTracer.Start(ctx, "store.DB."+op, oteltrace.WithAttributes(
+		attribute.String("db.table", table),
+	))
+}
+
+// recordDOMContexts annotates a span with the outcome of a getDOMContexts
+// call and updates the dom-context counters.
+func recordDOMContexts(span oteltrace.Span, contexts []types.DOMContext) {
+	span.SetAttributes(attribute.Int("dom.contexts.count", len(contexts)))
+	var highest uint
+	for _, c := range contexts {
+		domContextsTotal.WithLabelValues(severityLabel(c.Severity)).Inc()
+		if c.Severity > highest {
+			highest = c.Severity
+		}
+	}
+	span.SetAttributes(attribute.Int("event.severity", int(highest)))
+}
+
+func severityLabel(s uint) string {
+	switch {
+	case s == 0:
+		return "0"
+	case s == 1:
+		return "1"
+	case s == 2:
+		return "2"
+	default:
+		return "3+"
+	}
+}
+
+// traceRecord is one finished call kept in traceRing, a small fixed-size
+// in-process buffer, so /debug/traces has something to render without
+// standing up a full tracing backend. Duration is encoded in nanoseconds.
+type traceRecord struct {
+	Name     string        `json:"name"`
+	TracerID uint          `json:"tracerID"`
+	Duration time.Duration `json:"durationNS"`
+	Err      string        `json:"error,omitempty"`
+	At       time.Time     `json:"at"`
+}
+
+var (
+	traceRingMu sync.Mutex
+	traceRing   = make([]traceRecord, 0, 256)
+)
+
+func recordTrace(rec traceRecord) {
+	traceRingMu.Lock()
+	defer traceRingMu.Unlock()
+
+	if len(traceRing) >= cap(traceRing) {
+		traceRing = traceRing[1:]
+	}
+	traceRing = append(traceRing, rec)
+}
+
+// DebugTracesHandler renders in-process traces grouped by tracer ID, newest
+// first, for quick diagnosis when an HTML parse or DB insert is slow. It's
+// meant to be registered at /debug/traces by the HTTP router.
+func DebugTracesHandler(w http.ResponseWriter, r *http.Request) {
+	traceRingMu.Lock()
+	snapshot := make([]traceRecord, len(traceRing))
+	copy(snapshot, traceRing)
+	traceRingMu.Unlock()
+
+	byTracer := make(map[uint][]traceRecord)
+	for i := len(snapshot) - 1; i >= 0; i-- {
+		rec := snapshot[i]
+		byTracer[rec.TracerID] = append(byTracer[rec.TracerID], rec)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(byTracer); err != nil {
+		log.Warning.Print(err)
+	}
+}